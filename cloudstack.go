@@ -21,14 +21,17 @@ package cloudstack
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ablecloud-team/ablestack-mold-go/v2/cloudstack"
 	"gopkg.in/gcfg.v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 )
@@ -39,20 +42,55 @@ const ProviderName = "external-cloudstack"
 // CSConfig wraps the config for the CloudStack cloud provider.
 type CSConfig struct {
 	Global struct {
-		APIURL      string `gcfg:"api-url"`
-		APIKey      string `gcfg:"api-key"`
-		SecretKey   string `gcfg:"secret-key"`
-		SSLNoVerify bool   `gcfg:"ssl-no-verify"`
-		ProjectID   string `gcfg:"project-id"`
-		Zone        string `gcfg:"zone"`
+		APIURL       string `gcfg:"api-url"`
+		APIKey       string `gcfg:"api-key"`
+		SecretKey    string `gcfg:"secret-key"`
+		SSLNoVerify  bool   `gcfg:"ssl-no-verify"`
+		ProjectID    string `gcfg:"project-id"`
+		Zone         string `gcfg:"zone"`
+		MetadataOnly bool   `gcfg:"metadata-only"`
+
+		// MetadataCacheTTL sets how long a VirtualMachine lookup is cached
+		// for InstancesV2, e.g. "30s". Defaults to defaultMetadataCacheTTL.
+		MetadataCacheTTL string `gcfg:"metadata-cache-ttl"`
+
+		// PrimaryNetworkID pins which NIC's address becomes the node's
+		// primary NodeInternalIP when an instance has more than one.
+		PrimaryNetworkID string `gcfg:"primary-network-id"`
+		// PreferIPv6 makes the primary NodeInternalIP an IPv6 address when
+		// the primary NIC has one, instead of defaulting to IPv4.
+		PreferIPv6 bool `gcfg:"prefer-ipv6"`
+		// ExcludeNetworkIDs is a comma-separated list of network IDs whose
+		// NICs should never be reported as node addresses.
+		ExcludeNetworkIDs string `gcfg:"exclude-network-ids"`
+
+		// RouterNetworkID is the network whose VPC hosts the pod-CIDR
+		// static routes managed by the Routes controller. When unset, it
+		// is discovered from the VPC of the first node's NIC.
+		RouterNetworkID string `gcfg:"router-network-id"`
+
+		// APIQPS and APIBurst throttle client-side calls to the CloudStack
+		// API. Defaults to defaultAPIQPS / defaultAPIBurst.
+		APIQPS   float64 `gcfg:"api-qps"`
+		APIBurst int     `gcfg:"api-burst"`
 	}
 }
 
 // CSCloud is an implementation of Interface for CloudStack.
 type CSCloud struct {
-	client    *cloudstack.CloudStackClient
-	projectID string // If non-"", all resources will be created within this project
-	zone      string
+	client            *cloudstack.CloudStackClient
+	metadata          *metadataClient      // Used as a fallback when client is nil
+	vmCache           *vmCache             // Per-providerID cache of VirtualMachine lookups
+	kubeClient        kubernetes.Interface // Used by the Routes controller to list nodes
+	projectID         string               // If non-"", all resources will be created within this project
+	zone              string
+	primaryNetworkID  string
+	preferIPv6        bool
+	excludeNetworkIDs map[string]bool
+	routerNetworkID   string
+
+	routerNetMu sync.Mutex
+	routerNet   *cloudstack.Network // Resolved lazily and cached for the lifetime of the process, guarded by routerNetMu since the route controller calls ListRoutes/CreateRoute/DeleteRoute concurrently
 }
 
 func init() {
@@ -66,6 +104,21 @@ func init() {
 	})
 }
 
+// splitNetworkIDs parses a comma-separated list of network IDs, e.g. from
+// CSConfig.Global.ExcludeNetworkIDs, into a lookup set.
+func splitNetworkIDs(ids string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			set[id] = true
+		}
+	}
+
+	return set
+}
+
 func readConfig(config io.Reader) (*CSConfig, error) {
 	cfg := &CSConfig{}
 
@@ -83,16 +136,46 @@ func readConfig(config io.Reader) (*CSConfig, error) {
 // newCSCloud creates a new instance of CSCloud.
 func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 	cs := &CSCloud{
-		projectID: cfg.Global.ProjectID,
-		zone:      cfg.Global.Zone,
+		projectID:         cfg.Global.ProjectID,
+		zone:              cfg.Global.Zone,
+		primaryNetworkID:  cfg.Global.PrimaryNetworkID,
+		preferIPv6:        cfg.Global.PreferIPv6,
+		excludeNetworkIDs: splitNetworkIDs(cfg.Global.ExcludeNetworkIDs),
+		routerNetworkID:   cfg.Global.RouterNetworkID,
 	}
 
-	if cfg.Global.APIURL != "" && cfg.Global.APIKey != "" && cfg.Global.SecretKey != "" {
+	hasAnyAPIConfig := cfg.Global.APIURL != "" || cfg.Global.APIKey != "" || cfg.Global.SecretKey != ""
+	hasAPIConfig := cfg.Global.APIURL != "" && cfg.Global.APIKey != "" && cfg.Global.SecretKey != ""
+
+	if hasAnyAPIConfig && !hasAPIConfig {
+		klog.Warningf("Partial CloudStack API config given (api-url/api-key/secret-key must all be set); falling back to metadata-only mode")
+	}
+
+	if hasAPIConfig && !cfg.Global.MetadataOnly {
 		cs.client = cloudstack.NewAsyncClient(cfg.Global.APIURL, cfg.Global.APIKey, cfg.Global.SecretKey, !cfg.Global.SSLNoVerify)
+
+		// Install the retry/rate-limit/metrics transport once so every
+		// service on the client (VirtualMachine, VPC, Network,
+		// Resourcetags, ...) transparently goes through it.
+		cs.client.HTTPClient.Transport = newRetryingTransport(cs.client.HTTPClient.Transport, cfg.Global.APIQPS, cfg.Global.APIBurst)
+
+		cacheTTL, err := time.ParseDuration(cfg.Global.MetadataCacheTTL)
+		if err != nil {
+			cacheTTL = defaultMetadataCacheTTL
+		}
+		cs.vmCache = newVMCache(cacheTTL)
 	}
 
+	// Without API credentials (or when metadata-only is forced), fall back
+	// to resolving instance metadata through the DHCP-served metadata
+	// server instead of requiring a full API client.
 	if cs.client == nil {
-		return nil, errors.New("no cloud provider config given")
+		metadata, err := newMetadataClient()
+		if err != nil {
+			return nil, fmt.Errorf("no cloud provider config given and no metadata server could be found: %v", err)
+		}
+
+		cs.metadata = metadata
 	}
 
 	return cs, nil
@@ -100,6 +183,7 @@ func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 
 // Initialize passes a Kubernetes clientBuilder interface to the cloud provider
 func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	cs.kubeClient = clientBuilder.ClientOrDie("cloudstack-cloud-controller-manager")
 }
 
 // LoadBalancer returns an implementation of LoadBalancer for CloudStack.
@@ -113,7 +197,7 @@ func (cs *CSCloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 
 // Instances returns an implementation of Instances for CloudStack.
 func (cs *CSCloud) Instances() (cloudprovider.Instances, bool) {
-	if cs.client == nil {
+	if cs.client == nil && cs.metadata == nil {
 		return nil, false
 	}
 
@@ -121,7 +205,7 @@ func (cs *CSCloud) Instances() (cloudprovider.Instances, bool) {
 }
 
 func (cs *CSCloud) InstancesV2() (cloudprovider.InstancesV2, bool) {
-	if cs.client == nil {
+	if cs.client == nil && cs.metadata == nil {
 		return nil, false
 	}
 
@@ -130,7 +214,7 @@ func (cs *CSCloud) InstancesV2() (cloudprovider.InstancesV2, bool) {
 
 // Zones returns an implementation of Zones for CloudStack.
 func (cs *CSCloud) Zones() (cloudprovider.Zones, bool) {
-	if cs.client == nil {
+	if cs.client == nil && cs.metadata == nil {
 		return nil, false
 	}
 
@@ -153,8 +237,7 @@ func (cs *CSCloud) Routes() (cloudprovider.Routes, bool) {
 		return nil, false
 	}
 
-	klog.Warning("This cloud provider doesn't support routes")
-	return nil, false
+	return cs, true
 }
 
 // ProviderName returns the cloud provider ID.
@@ -171,6 +254,20 @@ func (cs *CSCloud) HasClusterID() bool {
 func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 	zone := cloudprovider.Zone{}
 
+	if cs.client == nil {
+		az, err := cs.metadata.availabilityZone()
+		if err != nil {
+			return zone, fmt.Errorf("error retrieving the zone from the metadata server: %v", err)
+		}
+
+		cs.zone = az
+		klog.V(2).Infof("Current zone is %v", cs.zone)
+		zone.FailureDomain = cs.zone
+		zone.Region = cs.zone
+
+		return zone, nil
+	}
+
 	if cs.zone == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -197,22 +294,16 @@ func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 
 // GetZoneByProviderID returns the Zone, found by using the provider ID.
 func (cs *CSCloud) GetZoneByProviderID(ctx context.Context, providerID string) (cloudprovider.Zone, error) {
-	zone := cloudprovider.Zone{}
-
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		providerID,
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, err := cs.vmByProviderID(providerID)
 	if err != nil {
-		if count == 0 {
-			return zone, fmt.Errorf("could not find node by ID: %v", providerID)
+		if err == cloudprovider.InstanceNotFound {
+			return cloudprovider.Zone{}, err
 		}
-		return zone, fmt.Errorf("error retrieving zone: %v", err)
+		return cloudprovider.Zone{}, fmt.Errorf("error retrieving zone: %v", err)
 	}
 
-	klog.V(2).Infof("Current zone is %v", cs.zone)
-	zone.FailureDomain = instance.Zonename
-	zone.Region = instance.Zonename
+	zone := zoneFromInstance(instance)
+	klog.V(2).Infof("Current zone is %v", zone.FailureDomain)
 
 	return zone, nil
 }
@@ -221,6 +312,10 @@ func (cs *CSCloud) GetZoneByProviderID(ctx context.Context, providerID string) (
 func (cs *CSCloud) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
 	zone := cloudprovider.Zone{}
 
+	if cs.client == nil {
+		return zone, fmt.Errorf("error retrieving zone for %v: %v", nodeName, errNoAPIClient)
+	}
+
 	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
 		string(nodeName),
 		cloudstack.WithProject(cs.projectID),
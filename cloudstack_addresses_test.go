@@ -0,0 +1,142 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"testing"
+
+	"github.com/ablecloud-team/ablestack-mold-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func addressesByType(addresses []corev1.NodeAddress, t corev1.NodeAddressType) []string {
+	var values []string
+	for _, addr := range addresses {
+		if addr.Type == t {
+			values = append(values, addr.Address)
+		}
+	}
+	return values
+}
+
+func TestNodeAddressesSingleNIC(t *testing.T) {
+	cs := &CSCloud{}
+	instance := &cloudstack.VirtualMachine{
+		Id:       "i-1",
+		Hostname: "node-1",
+		Nic: []cloudstack.Nic{
+			{Networkid: "net-1", Ipaddress: "10.0.0.5"},
+		},
+	}
+
+	addresses, err := cs.nodeAddresses(instance, nil)
+	if err != nil {
+		t.Fatalf("nodeAddresses() error = %v", err)
+	}
+
+	internal := addressesByType(addresses, corev1.NodeInternalIP)
+	if len(internal) != 1 || internal[0] != "10.0.0.5" {
+		t.Errorf("internal addresses = %v, want [10.0.0.5]", internal)
+	}
+
+	hostnames := addressesByType(addresses, corev1.NodeHostName)
+	if len(hostnames) != 1 || hostnames[0] != "node-1" {
+		t.Errorf("hostnames = %v, want [node-1]", hostnames)
+	}
+}
+
+func TestNodeAddressesDualStack(t *testing.T) {
+	cs := &CSCloud{primaryNetworkID: "net-1"}
+	instance := &cloudstack.VirtualMachine{
+		Id: "i-2",
+		Nic: []cloudstack.Nic{
+			{Networkid: "net-1", Ipaddress: "10.0.0.5", Ip6address: "fd00::5"},
+			{Networkid: "net-2", Ipaddress: "10.0.1.5"},
+		},
+	}
+
+	addresses, err := cs.nodeAddresses(instance, nil)
+	if err != nil {
+		t.Fatalf("nodeAddresses() error = %v", err)
+	}
+
+	internal := addressesByType(addresses, corev1.NodeInternalIP)
+	if len(internal) != 3 {
+		t.Fatalf("internal addresses = %v, want 3 entries", internal)
+	}
+	if internal[0] != "10.0.0.5" {
+		t.Errorf("primary internal address = %v, want 10.0.0.5 (primary-network-id NIC, IPv4 preferred)", internal[0])
+	}
+}
+
+func TestNodeAddressesDualStackPreferIPv6(t *testing.T) {
+	cs := &CSCloud{primaryNetworkID: "net-1", preferIPv6: true}
+	instance := &cloudstack.VirtualMachine{
+		Id: "i-3",
+		Nic: []cloudstack.Nic{
+			{Networkid: "net-1", Ipaddress: "10.0.0.5", Ip6address: "fd00::5"},
+		},
+	}
+
+	addresses, err := cs.nodeAddresses(instance, nil)
+	if err != nil {
+		t.Fatalf("nodeAddresses() error = %v", err)
+	}
+
+	internal := addressesByType(addresses, corev1.NodeInternalIP)
+	if len(internal) != 2 || internal[0] != "fd00::5" {
+		t.Errorf("internal addresses = %v, want [fd00::5 10.0.0.5] (preferIPv6)", internal)
+	}
+}
+
+func TestNodeAddressesPublicNICOnly(t *testing.T) {
+	cs := &CSCloud{}
+	instance := &cloudstack.VirtualMachine{
+		Id: "i-4",
+		Nic: []cloudstack.Nic{
+			{Networkid: "net-1", Ipaddress: "10.0.0.5"},
+			{Networkid: "net-2", Traffictype: "Public", Ipaddress: "203.0.113.10"},
+		},
+	}
+
+	addresses, err := cs.nodeAddresses(instance, nil)
+	if err != nil {
+		t.Fatalf("nodeAddresses() error = %v", err)
+	}
+
+	internal := addressesByType(addresses, corev1.NodeInternalIP)
+	if len(internal) != 1 || internal[0] != "10.0.0.5" {
+		t.Errorf("internal addresses = %v, want [10.0.0.5]", internal)
+	}
+
+	external := addressesByType(addresses, corev1.NodeExternalIP)
+	if len(external) != 1 || external[0] != "203.0.113.10" {
+		t.Errorf("external addresses = %v, want [203.0.113.10]", external)
+	}
+}
+
+func TestNodeAddressesNoInternalIP(t *testing.T) {
+	cs := &CSCloud{}
+	instance := &cloudstack.VirtualMachine{Id: "i-5"}
+
+	if _, err := cs.nodeAddresses(instance, nil); err == nil {
+		t.Error("nodeAddresses() error = nil, want error for instance with no NICs")
+	}
+}
@@ -34,8 +34,17 @@ import (
 
 var labelInvalidCharsRegex *regexp.Regexp = regexp.MustCompile(`([^A-Za-z0-9][^-A-Za-z0-9_.]*)?[^A-Za-z0-9]`)
 
+// nodeProvidedIPAnnotation lets an operator pin which address kubelet
+// reports as its primary internal IP, breaking ties the same way the
+// kubelet-reported-IP discovery logic does for other in-tree providers.
+const nodeProvidedIPAnnotation = "alpha.kubernetes.io/provided-node-ip"
+
 // NodeAddresses returns the addresses of the specified instance.
 func (cs *CSCloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]corev1.NodeAddress, error) {
+	if cs.client == nil {
+		return cs.nodeAddressesFromMetadata()
+	}
+
 	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
 		string(name),
 		cloudstack.WithProject(cs.projectID),
@@ -47,41 +56,110 @@ func (cs *CSCloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]co
 		return nil, fmt.Errorf("error retrieving node addresses: %v", err)
 	}
 
-	return cs.nodeAddresses(instance)
+	return cs.nodeAddresses(instance, nil)
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
 func (cs *CSCloud) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]corev1.NodeAddress, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		providerID,
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, err := cs.vmByProviderID(providerID)
 	if err != nil {
-		if count == 0 {
-			return nil, cloudprovider.InstanceNotFound
-		}
-		return nil, fmt.Errorf("error retrieving node addresses: %v", err)
+		return nil, err
 	}
 
-	return cs.nodeAddresses(instance)
+	return cs.nodeAddresses(instance, nil)
 }
 
-func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]corev1.NodeAddress, error) {
+// nodeAddresses builds the NodeAddress list for instance, walking every NIC
+// instead of just the first one so that multi-NIC and dual-stack VMs are
+// fully reported. node is optional and, when given, its
+// nodeProvidedIPAnnotation is used to break ties over which address becomes
+// the primary NodeInternalIP.
+func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine, node *corev1.Node) ([]corev1.NodeAddress, error) {
 	if len(instance.Nic) == 0 {
 		return nil, errors.New("instance does not have an internal IP")
 	}
 
-	addresses := []corev1.NodeAddress{
-		{Type: corev1.NodeInternalIP, Address: instance.Nic[0].Ipaddress},
+	var preferredIP string
+	if node != nil {
+		preferredIP = node.Annotations[nodeProvidedIPAnnotation]
+	}
+
+	var internal, external []corev1.NodeAddress
+	primaryIdx, primaryRank := -1, 0
+
+	// rank orders the candidates for the primary NodeInternalIP: the
+	// primary-network-id NIC's address in the preferred family, then its
+	// other address, then the nodeProvidedIPAnnotation address, then the
+	// first address found.
+	rank := func(addr string, onPrimaryNetwork, preferredFamily bool) int {
+		switch {
+		case onPrimaryNetwork && preferredFamily:
+			return 4
+		case onPrimaryNetwork:
+			return 3
+		case addr == preferredIP:
+			return 2
+		}
+		return 1
+	}
+
+	for _, nic := range instance.Nic {
+		if cs.excludeNetworkIDs[nic.Networkid] {
+			continue
+		}
+
+		// A NIC on CloudStack's "Public" traffic type is routable from
+		// outside the cluster and is reported as an external address
+		// instead of being folded into the internal ones below.
+		if nic.Traffictype == "Public" {
+			if nic.Ipaddress != "" {
+				external = append(external, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: nic.Ipaddress})
+			}
+			if nic.Ip6address != "" {
+				external = append(external, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: nic.Ip6address})
+			}
+			continue
+		}
+
+		isPrimaryNetwork := cs.primaryNetworkID != "" && nic.Networkid == cs.primaryNetworkID
+
+		if nic.Ipaddress != "" {
+			internal = append(internal, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: nic.Ipaddress})
+			if r := rank(nic.Ipaddress, isPrimaryNetwork, !cs.preferIPv6); r > primaryRank {
+				primaryIdx, primaryRank = len(internal)-1, r
+			}
+		}
+
+		if nic.Ip6address != "" {
+			internal = append(internal, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: nic.Ip6address})
+			if r := rank(nic.Ip6address, isPrimaryNetwork, cs.preferIPv6); r > primaryRank {
+				primaryIdx, primaryRank = len(internal)-1, r
+			}
+		}
+	}
+
+	if len(internal) == 0 {
+		return nil, errors.New("instance does not have an internal IP")
+	}
+
+	addresses := make([]corev1.NodeAddress, 0, len(internal)+len(external)+1)
+	addresses = append(addresses, internal[primaryIdx])
+	for i, addr := range internal {
+		if i != primaryIdx {
+			addresses = append(addresses, addr)
+		}
 	}
 
 	if instance.Hostname != "" {
 		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: instance.Hostname})
 	}
 
-	if instance.Publicip != "" {
+	switch {
+	case len(external) > 0:
+		addresses = append(addresses, external...)
+	case instance.Publicip != "":
 		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: instance.Publicip})
-	} else {
+	default:
 		// Since there is no sane way to determine the external IP if the host isn't
 		// using static NAT, we will just fire a log message and omit the external IP.
 		klog.V(4).Infof("Could not determine the public IP of host %v (%v)", instance.Name, instance.Id)
@@ -90,8 +168,44 @@ func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]corev1.
 	return addresses, nil
 }
 
+// nodeAddressesFromMetadata returns the addresses of the current instance as
+// reported by the DHCP-served metadata server, for use when no CloudStack
+// API client is configured.
+func (cs *CSCloud) nodeAddressesFromMetadata() ([]corev1.NodeAddress, error) {
+	internalIP, err := cs.metadata.localIPv4()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving node addresses: %v", err)
+	}
+
+	addresses := []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: internalIP},
+	}
+
+	if hostname, err := cs.metadata.publicHostname(); err == nil && hostname != "" {
+		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: hostname})
+	}
+
+	if publicIP, err := cs.metadata.publicIPv4(); err == nil && publicIP != "" {
+		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: publicIP})
+	} else {
+		// Since there is no sane way to determine the external IP if the host isn't
+		// using static NAT, we will just fire a log message and omit the external IP.
+		klog.V(4).Infof("Could not determine the public IP of this host from the metadata server")
+	}
+
+	return addresses, nil
+}
+
 // InstanceID returns the cloud provider ID of the specified instance.
 func (cs *CSCloud) InstanceID(ctx context.Context, name types.NodeName) (string, error) {
+	if cs.client == nil {
+		id, err := cs.metadata.instanceID()
+		if err != nil {
+			return "", fmt.Errorf("error retrieving instance ID: %v", err)
+		}
+		return id, nil
+	}
+
 	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
 		string(name),
 		cloudstack.WithProject(cs.projectID),
@@ -108,6 +222,14 @@ func (cs *CSCloud) InstanceID(ctx context.Context, name types.NodeName) (string,
 
 // InstanceType returns the type of the specified instance.
 func (cs *CSCloud) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
+	if cs.client == nil {
+		offering, err := cs.metadata.serviceOffering()
+		if err != nil {
+			return "", fmt.Errorf("error retrieving instance type: %v", err)
+		}
+		return labelInvalidCharsRegex.ReplaceAllString(offering, ``), nil
+	}
+
 	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
 		string(name),
 		cloudstack.WithProject(cs.projectID),
@@ -124,18 +246,91 @@ func (cs *CSCloud) InstanceType(ctx context.Context, name types.NodeName) (strin
 
 // InstanceTypeByProviderID returns the type of the specified instance.
 func (cs *CSCloud) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
+	instance, err := cs.vmByProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+
+	return instanceType(instance), nil
+}
+
+// instanceType extracts the Kubernetes-safe instance type label from a
+// CloudStack VirtualMachine's service offering.
+func instanceType(instance *cloudstack.VirtualMachine) string {
+	return labelInvalidCharsRegex.ReplaceAllString(instance.Serviceofferingname, ``)
+}
+
+// zoneFromInstance builds the cloudprovider.Zone for a CloudStack
+// VirtualMachine without making any additional API calls.
+func zoneFromInstance(instance *cloudstack.VirtualMachine) cloudprovider.Zone {
+	return cloudprovider.Zone{
+		FailureDomain: instance.Zonename,
+		Region:        instance.Zonename,
+	}
+}
+
+// errNoAPIClient is returned by CloudStack API helpers that have no
+// meaningful fallback when CSCloud is running in metadata-only mode, i.e.
+// any lookup that isn't about the local instance itself.
+var errNoAPIClient = errors.New("not supported without a CloudStack API client (metadata-only mode)")
+
+// vmByProviderID returns the VirtualMachine for providerID, consulting the
+// vmCache before calling out to the CloudStack API.
+func (cs *CSCloud) vmByProviderID(providerID string) (*cloudstack.VirtualMachine, error) {
+	if cs.client == nil {
+		return nil, errNoAPIClient
+	}
+
+	if vm, ok := cs.vmCache.get(providerID); ok {
+		return vm, nil
+	}
+
 	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
 		providerID,
 		cloudstack.WithProject(cs.projectID),
 	)
 	if err != nil {
 		if count == 0 {
-			return "", cloudprovider.InstanceNotFound
+			return nil, cloudprovider.InstanceNotFound
 		}
-		return "", fmt.Errorf("error retrieving instance type: %v", err)
+		return nil, fmt.Errorf("error retrieving instance: %v", err)
 	}
 
-	return labelInvalidCharsRegex.ReplaceAllString(instance.Serviceofferingname, ``), nil
+	cs.vmCache.set(providerID, instance)
+	return instance, nil
+}
+
+// vmByNodeName returns the VirtualMachine backing name, resolving it by name
+// and caching the result under its providerID so that subsequent
+// ByProviderID lookups for the same node are served from the vmCache.
+func (cs *CSCloud) vmByNodeName(name types.NodeName) (*cloudstack.VirtualMachine, error) {
+	if cs.client == nil {
+		return nil, errNoAPIClient
+	}
+
+	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
+		string(name),
+		cloudstack.WithProject(cs.projectID),
+	)
+	if err != nil {
+		if count == 0 {
+			return nil, cloudprovider.InstanceNotFound
+		}
+		return nil, fmt.Errorf("error retrieving instance: %v", err)
+	}
+
+	cs.vmCache.set(instance.Id, instance)
+	return instance, nil
+}
+
+// vmForNode returns the VirtualMachine backing node, preferring the cached
+// providerID lookup once the node has been assigned one.
+func (cs *CSCloud) vmForNode(node *corev1.Node) (*cloudstack.VirtualMachine, error) {
+	if node.Spec.ProviderID != "" {
+		return cs.vmByProviderID(node.Spec.ProviderID)
+	}
+
+	return cs.vmByNodeName(types.NodeName(node.Name))
 }
 
 // AddSSHKeyToAllInstances is currently not implemented.
@@ -150,23 +345,54 @@ func (cs *CSCloud) CurrentNodeName(ctx context.Context, hostname string) (types.
 
 // InstanceExistsByProviderID returns if the instance still exists.
 func (cs *CSCloud) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
-	_, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		providerID,
-		cloudstack.WithProject(cs.projectID),
-	)
+	_, err := cs.vmByProviderID(providerID)
 	if err != nil {
-		if count == 0 {
+		if err == cloudprovider.InstanceNotFound {
 			return false, nil
 		}
-		return false, fmt.Errorf("error retrieving instance: %v", err)
+		return false, err
 	}
 
 	return true, nil
 }
 
+// instanceShutdownStates are the CloudStack VM states that indicate an
+// instance is stopped (or on its way down) and safe to detach volumes from.
+var instanceShutdownStates = map[string]bool{
+	"Stopped":    true,
+	"Stopping":   true,
+	"Shutdowned": true,
+	"Destroyed":  true,
+}
+
+// instanceRunningStates are the CloudStack VM states that indicate an
+// instance is still up and running.
+var instanceRunningStates = map[string]bool{
+	"Running":  true,
+	"Starting": true,
+}
+
+// instanceShutdown maps a CloudStack VM's state to the InstancesV2/Instances
+// shutdown semantics expected by Kubernetes.
+func instanceShutdown(instance *cloudstack.VirtualMachine) (bool, error) {
+	switch {
+	case instanceShutdownStates[instance.State]:
+		return true, nil
+	case instanceRunningStates[instance.State]:
+		return false, nil
+	default:
+		return false, fmt.Errorf("instance %v is in an unhandled state: %v", instance.Id, instance.State)
+	}
+}
+
 // InstanceShutdownByProviderID returns true if the instance is in safe state to detach volumes
 func (cs *CSCloud) InstanceShutdownByProviderID(ctx context.Context, providerID string) (bool, error) {
-	return false, cloudprovider.NotImplemented
+	instance, err := cs.vmByProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+
+	return instanceShutdown(instance)
 }
 
 func (cs *CSCloud) InstanceExists(ctx context.Context, node *corev1.Node) (bool, error) {
@@ -180,31 +406,60 @@ func (cs *CSCloud) InstanceExists(ctx context.Context, node *corev1.Node) (bool,
 }
 
 func (cs *CSCloud) InstanceShutdown(ctx context.Context, node *corev1.Node) (bool, error) {
-	return false, cloudprovider.NotImplemented
+	providerID, err := cs.InstanceID(ctx, types.NodeName(node.Name))
+	if err != nil {
+		return false, err
+	}
+
+	return cs.InstanceShutdownByProviderID(ctx, providerID)
 }
 
 func (cs *CSCloud) InstanceMetadata(ctx context.Context, node *corev1.Node) (*cloudprovider.InstanceMetadata, error) {
+	if cs.client == nil {
+		instanceType, err := cs.InstanceType(ctx, types.NodeName(node.Name))
+		if err != nil {
+			return nil, err
+		}
 
-	instanceType, err := cs.InstanceType(ctx, types.NodeName(node.Name))
-	if err != nil {
-		return nil, err
+		addresses, err := cs.NodeAddresses(ctx, types.NodeName(node.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		zone, err := cs.GetZone(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cloudprovider.InstanceMetadata{
+			ProviderID:    cs.ProviderName(),
+			InstanceType:  instanceType,
+			NodeAddresses: addresses,
+			Zone:          cs.zone,
+			Region:        zone.Region,
+		}, nil
 	}
 
-	addresses, err := cs.NodeAddresses(ctx, types.NodeName(node.Name))
+	// A single cached VirtualMachine lookup backs all three pieces of
+	// metadata below, instead of the three separate CloudStack API round
+	// trips this used to take per node sync.
+	instance, err := cs.vmForNode(node)
 	if err != nil {
 		return nil, err
 	}
 
-	zone, err := cs.GetZone(ctx)
+	addresses, err := cs.nodeAddresses(instance, node)
 	if err != nil {
 		return nil, err
 	}
 
+	zone := zoneFromInstance(instance)
+
 	return &cloudprovider.InstanceMetadata{
 		ProviderID:    cs.ProviderName(),
-		InstanceType:  instanceType,
+		InstanceType:  instanceType(instance),
 		NodeAddresses: addresses,
-		Zone:          cs.zone,
+		Zone:          zone.FailureDomain,
 		Region:        zone.Region,
 	}, nil
 }
@@ -0,0 +1,336 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ablecloud-team/ablestack-mold-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// routeOwnerTagKey tags every route (VPC static route or isolated-network
+// egress rule) this cluster creates, so ListRoutes only ever reconciles
+// routes it actually owns, even when other workloads share the same network.
+const routeOwnerTagKey = "ablestack-kubernetes-provider-clusterid"
+
+// routeNodeTagKey records which node an isolated network's egress rule was
+// created for. Unlike a VPC static route, a CloudStack egress firewall rule
+// has no gateway/next-hop field to recover this from, so it has to be tagged.
+const routeNodeTagKey = "ablestack-kubernetes-provider-routenode"
+
+// ListRoutes lists all pod-CIDR routes this cluster owns in its configured
+// (or discovered) router network: VPC static routes when that network sits
+// in a VPC, or egress firewall rules when it's an isolated network.
+func (cs *CSCloud) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	network, err := cs.routerNetwork(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if network.Vpcid == "" {
+		return cs.listIsolatedRoutes(network.Id, clusterName)
+	}
+
+	return cs.listVPCRoutes(ctx, network.Vpcid, clusterName)
+}
+
+// CreateRoute creates a route for route.DestinationCIDR with a next hop of
+// route.TargetNode, either as a VPC static route or, on an isolated network,
+// as an egress firewall rule admitting the destination CIDR.
+func (cs *CSCloud) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	network, err := cs.routerNetwork(ctx)
+	if err != nil {
+		return err
+	}
+
+	if network.Vpcid == "" {
+		return cs.createIsolatedRoute(network.Id, clusterName, route)
+	}
+
+	return cs.createVPCRoute(network.Vpcid, clusterName, route)
+}
+
+// DeleteRoute deletes the route previously created for route.
+func (cs *CSCloud) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	network, err := cs.routerNetwork(ctx)
+	if err != nil {
+		return err
+	}
+
+	if network.Vpcid == "" {
+		return cs.deleteIsolatedRoute(route)
+	}
+
+	return cs.deleteVPCRoute(route)
+}
+
+// listVPCRoutes lists the pod-CIDR static routes this cluster owns in vpcID.
+func (cs *CSCloud) listVPCRoutes(ctx context.Context, vpcID string, clusterName string) ([]*cloudprovider.Route, error) {
+	nodeNameByInternalIP, err := cs.nodeNamesByInternalIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p := cs.client.VPC.NewListStaticRoutesParams()
+	p.SetVpcid(vpcID)
+	p.SetTags(map[string]string{routeOwnerTagKey: clusterName})
+
+	resp, err := cs.client.VPC.ListStaticRoutes(p)
+	if err != nil {
+		return nil, fmt.Errorf("error listing static routes: %v", err)
+	}
+
+	routes := make([]*cloudprovider.Route, 0, len(resp.StaticRoutes))
+	for _, sr := range resp.StaticRoutes {
+		nodeName, ok := nodeNameByInternalIP[sr.Gatewayid]
+		if !ok {
+			klog.V(4).Infof("Skipping static route %v: no node found for next hop %v", sr.Id, sr.Gatewayid)
+			continue
+		}
+
+		routes = append(routes, &cloudprovider.Route{
+			Name:            sr.Id,
+			TargetNode:      types.NodeName(nodeName),
+			DestinationCIDR: sr.Cidr,
+		})
+	}
+
+	return routes, nil
+}
+
+// createVPCRoute creates a VPC static route for route.DestinationCIDR with a
+// next hop of route.TargetNode's primary internal IP.
+func (cs *CSCloud) createVPCRoute(vpcID string, clusterName string, route *cloudprovider.Route) error {
+	nextHop, err := cs.internalIPForNode(route.TargetNode)
+	if err != nil {
+		return fmt.Errorf("error resolving next hop for %v: %v", route.TargetNode, err)
+	}
+
+	p := cs.client.VPC.NewCreateStaticRouteParams(route.DestinationCIDR, nextHop)
+	p.SetVpcid(vpcID)
+
+	resp, err := cs.client.VPC.CreateStaticRoute(p)
+	if err != nil {
+		return fmt.Errorf("error creating route for %v via %v: %v", route.DestinationCIDR, route.TargetNode, err)
+	}
+
+	tagParams := cs.client.Resourcetags.NewCreateTagsParams([]string{resp.Id}, "StaticRoute", map[string]string{routeOwnerTagKey: clusterName})
+	if _, err := cs.client.Resourcetags.CreateTags(tagParams); err != nil {
+		klog.Warningf("Could not tag static route %v as owned by %v: %v", resp.Id, clusterName, err)
+	}
+
+	return nil
+}
+
+// deleteVPCRoute deletes the VPC static route previously created for route.
+func (cs *CSCloud) deleteVPCRoute(route *cloudprovider.Route) error {
+	p := cs.client.VPC.NewDeleteStaticRouteParams(route.Name)
+
+	if _, err := cs.client.VPC.DeleteStaticRoute(p); err != nil {
+		return fmt.Errorf("error deleting route %v: %v", route.Name, err)
+	}
+
+	return nil
+}
+
+// listIsolatedRoutes lists the pod-CIDR egress firewall rules this cluster
+// owns on the isolated network networkID. An isolated network has no VPC
+// static routes; nodes reach each other's pod CIDRs over the network's
+// shared L2, so the only thing standing in the way is the network's default
+// deny-all egress policy, which these rules punch a hole in.
+func (cs *CSCloud) listIsolatedRoutes(networkID string, clusterName string) ([]*cloudprovider.Route, error) {
+	p := cs.client.Firewall.NewListEgressFirewallRulesParams()
+	p.SetNetworkid(networkID)
+	p.SetTags(map[string]string{routeOwnerTagKey: clusterName})
+
+	resp, err := cs.client.Firewall.ListEgressFirewallRules(p)
+	if err != nil {
+		return nil, fmt.Errorf("error listing egress firewall rules: %v", err)
+	}
+
+	routes := make([]*cloudprovider.Route, 0, len(resp.EgressFirewallRules))
+	for _, rule := range resp.EgressFirewallRules {
+		nodeName := nodeNameFromTags(rule.Tags, routeNodeTagKey)
+		if nodeName == "" {
+			klog.V(4).Infof("Skipping egress firewall rule %v: no %v tag found", rule.Id, routeNodeTagKey)
+			continue
+		}
+
+		routes = append(routes, &cloudprovider.Route{
+			Name:            rule.Id,
+			TargetNode:      types.NodeName(nodeName),
+			DestinationCIDR: rule.Cidrlist,
+		})
+	}
+
+	return routes, nil
+}
+
+// createIsolatedRoute admits route.DestinationCIDR through networkID's
+// egress firewall, tagged with the owning cluster and target node so
+// listIsolatedRoutes and deleteIsolatedRoute can recognize it later.
+func (cs *CSCloud) createIsolatedRoute(networkID string, clusterName string, route *cloudprovider.Route) error {
+	p := cs.client.Firewall.NewCreateEgressFirewallRuleParams(networkID, "all")
+	p.SetCidrlist([]string{route.DestinationCIDR})
+
+	resp, err := cs.client.Firewall.CreateEgressFirewallRule(p)
+	if err != nil {
+		return fmt.Errorf("error creating egress firewall rule for %v via %v: %v", route.DestinationCIDR, route.TargetNode, err)
+	}
+
+	tags := map[string]string{
+		routeOwnerTagKey: clusterName,
+		routeNodeTagKey:  string(route.TargetNode),
+	}
+	tagParams := cs.client.Resourcetags.NewCreateTagsParams([]string{resp.Id}, "FirewallRule", tags)
+	if _, err := cs.client.Resourcetags.CreateTags(tagParams); err != nil {
+		klog.Warningf("Could not tag egress firewall rule %v as owned by %v: %v", resp.Id, clusterName, err)
+	}
+
+	return nil
+}
+
+// deleteIsolatedRoute removes the egress firewall rule previously created
+// for route.
+func (cs *CSCloud) deleteIsolatedRoute(route *cloudprovider.Route) error {
+	p := cs.client.Firewall.NewDeleteEgressFirewallRuleParams(route.Name)
+
+	if _, err := cs.client.Firewall.DeleteEgressFirewallRule(p); err != nil {
+		return fmt.Errorf("error deleting egress firewall rule %v: %v", route.Name, err)
+	}
+
+	return nil
+}
+
+// routerNetwork resolves (and caches) the network backing the cluster's
+// pod-CIDR routes, either from CSConfig.Global.RouterNetworkID or, when
+// unset, from the network of the first node's first NIC. It's guarded by
+// routerNetMu since the route controller calls ListRoutes/CreateRoute/
+// DeleteRoute concurrently, one goroutine per node.
+func (cs *CSCloud) routerNetwork(ctx context.Context) (*cloudstack.Network, error) {
+	cs.routerNetMu.Lock()
+	defer cs.routerNetMu.Unlock()
+
+	if cs.routerNet != nil {
+		return cs.routerNet, nil
+	}
+
+	networkID := cs.routerNetworkID
+	if networkID == "" {
+		id, err := cs.discoverRouterNetworkID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		networkID = id
+	}
+
+	network, count, err := cs.client.Network.GetNetworkByID(networkID)
+	if err != nil {
+		if count == 0 {
+			return nil, fmt.Errorf("could not find network %v for the routes controller", networkID)
+		}
+		return nil, fmt.Errorf("error retrieving network %v for the routes controller: %v", networkID, err)
+	}
+
+	cs.routerNet = network
+	return cs.routerNet, nil
+}
+
+// discoverRouterNetworkID falls back to the network of the first node's
+// first NIC when no router-network-id has been configured.
+func (cs *CSCloud) discoverRouterNetworkID(ctx context.Context) (string, error) {
+	nodes, err := cs.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return "", fmt.Errorf("error listing nodes to discover the router network: %v", err)
+	}
+	if len(nodes.Items) == 0 {
+		return "", errors.New("no nodes found to discover the router network from")
+	}
+
+	instance, err := cs.vmForNode(&nodes.Items[0])
+	if err != nil {
+		return "", fmt.Errorf("error resolving instance for %v: %v", nodes.Items[0].Name, err)
+	}
+	if len(instance.Nic) == 0 {
+		return "", fmt.Errorf("instance %v has no NICs to discover the router network from", instance.Name)
+	}
+
+	return instance.Nic[0].Networkid, nil
+}
+
+// internalIPForNode returns the primary NodeInternalIP CloudStack reports
+// for nodeName, for use as a static route's next hop.
+func (cs *CSCloud) internalIPForNode(nodeName types.NodeName) (string, error) {
+	instance, err := cs.vmByNodeName(nodeName)
+	if err != nil {
+		return "", err
+	}
+
+	addresses, err := cs.nodeAddresses(instance, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			return addr.Address, nil
+		}
+	}
+
+	return "", fmt.Errorf("instance %v has no internal IP to use as a route next hop", instance.Id)
+}
+
+// nodeNamesByInternalIP lists the cluster's nodes and indexes them by every
+// NodeInternalIP address they report, so a static route's next hop can be
+// mapped back to a node name.
+func (cs *CSCloud) nodeNamesByInternalIP(ctx context.Context) (map[string]string, error) {
+	nodes, err := cs.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing nodes to resolve route next hops: %v", err)
+	}
+
+	byIP := make(map[string]string, len(nodes.Items))
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == corev1.NodeInternalIP {
+				byIP[addr.Address] = node.Name
+			}
+		}
+	}
+
+	return byIP, nil
+}
+
+// nodeNameFromTags returns the value of the tag named key, if present.
+func nodeNameFromTags(tags []cloudstack.Tags, key string) string {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
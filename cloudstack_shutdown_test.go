@@ -0,0 +1,57 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"testing"
+
+	"github.com/ablecloud-team/ablestack-mold-go/v2/cloudstack"
+)
+
+func TestInstanceShutdown(t *testing.T) {
+	tests := []struct {
+		state        string
+		wantShutdown bool
+		wantErr      bool
+	}{
+		{state: "Stopped", wantShutdown: true},
+		{state: "Stopping", wantShutdown: true},
+		{state: "Shutdowned", wantShutdown: true},
+		{state: "Destroyed", wantShutdown: true},
+		{state: "Running", wantShutdown: false},
+		{state: "Starting", wantShutdown: false},
+		{state: "Migrating", wantShutdown: false, wantErr: true},
+		{state: "", wantShutdown: false, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			instance := &cloudstack.VirtualMachine{Id: "i-1", State: test.state}
+
+			shutdown, err := instanceShutdown(instance)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("instanceShutdown(%q) error = %v, wantErr %v", test.state, err, test.wantErr)
+			}
+			if shutdown != test.wantShutdown {
+				t.Errorf("instanceShutdown(%q) = %v, want %v", test.state, shutdown, test.wantShutdown)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ablecloud-team/ablestack-mold-go/v2/cloudstack"
+)
+
+// defaultMetadataCacheTTL is used when CSConfig.Global.MetadataCacheTTL is
+// unset or fails to parse.
+const defaultMetadataCacheTTL = 30 * time.Second
+
+// vmCacheMaxEntries bounds how many virtual machines are kept in memory at
+// once, evicting the least recently used entry once the limit is reached.
+const vmCacheMaxEntries = 1024
+
+// vmCacheEntry is the value stored in the cache's linked list.
+type vmCacheEntry struct {
+	providerID string
+	vm         *cloudstack.VirtualMachine
+	expiresAt  time.Time
+}
+
+// vmCache is a small, short-TTL LRU cache of CloudStack VirtualMachine
+// lookups keyed by providerID. It exists to collapse the multiple
+// GetVirtualMachineBy{Name,ID} calls InstancesV2 used to make per node sync
+// into a single CloudStack API round-trip.
+type vmCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// newVMCache creates a vmCache with the given TTL, falling back to
+// defaultMetadataCacheTTL when ttl is not positive.
+func newVMCache(ttl time.Duration) *vmCache {
+	if ttl <= 0 {
+		ttl = defaultMetadataCacheTTL
+	}
+
+	return &vmCache{
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached VirtualMachine for providerID, if present and not
+// yet expired.
+func (c *vmCache) get(providerID string) (*cloudstack.VirtualMachine, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[providerID]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*vmCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, providerID)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.vm, true
+}
+
+// set stores vm under providerID, refreshing its TTL and evicting the least
+// recently used entry if the cache is full.
+func (c *vmCache) set(providerID string, vm *cloudstack.VirtualMachine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[providerID]; ok {
+		entry := elem.Value.(*vmCacheEntry)
+		entry.vm = vm
+		entry.expiresAt = time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(&vmCacheEntry{
+		providerID: providerID,
+		vm:         vm,
+		expiresAt:  time.Now().Add(c.ttl),
+	})
+	c.entries[providerID] = elem
+
+	if c.order.Len() > vmCacheMaxEntries {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*vmCacheEntry).providerID)
+		}
+	}
+}
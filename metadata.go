@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	metadataBaseURLFormat  = "http://%s/latest/meta-data/"
+	metadataRequestTimeout = 10 * time.Second
+)
+
+// dhcpLeaseGlobs are the well-known locations of DHCP client lease files
+// across the distributions ablestack-kubernetes-provider is expected to run
+// on.
+var dhcpLeaseGlobs = []string{
+	"/var/lib/dhclient/*.lease",
+	"/var/lib/dhclient/*.leases",
+	"/var/lib/dhcp/dhclient*.leases",
+	"/run/systemd/netif/leases/*",
+}
+
+var (
+	dhclientServerIdentifierRegex = regexp.MustCompile(`dhcp-server-identifier\s+([0-9.]+)\s*;`)
+	systemdServerAddressRegex     = regexp.MustCompile(`SERVER_ADDRESS=([0-9.]+)`)
+)
+
+// metadataClient resolves instance metadata straight from the CloudStack
+// virtual router's DHCP/metadata service, without requiring any API
+// credentials. It backs CSCloud when it is configured without an
+// api-url/api-key/secret-key triplet (or with metadata-only forced on),
+// which lets the same binary run as an unprivileged in-VM metadata resolver
+// on kubelets while the cloud-controller-manager keeps using the full API.
+type metadataClient struct {
+	httpClient *http.Client
+	serverAddr string
+}
+
+// newMetadataClient discovers the DHCP server that served this node's lease
+// and returns a client able to fetch CloudStack meta-data from it.
+func newMetadataClient() (*metadataClient, error) {
+	addr, err := discoverDHCPServerAddress()
+	if err != nil {
+		return nil, fmt.Errorf("could not discover a DHCP server to use for metadata access: %v", err)
+	}
+
+	klog.V(2).Infof("Using %v as the metadata server", addr)
+
+	return &metadataClient{
+		httpClient: &http.Client{Timeout: metadataRequestTimeout},
+		serverAddr: addr,
+	}, nil
+}
+
+// discoverDHCPServerAddress scans the known dhclient and systemd-networkd
+// lease file locations for a dhcp-server-identifier / SERVER_ADDRESS entry.
+func discoverDHCPServerAddress() (string, error) {
+	for _, pattern := range dhcpLeaseGlobs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			klog.V(4).Infof("Invalid lease file glob %v: %v", pattern, err)
+			continue
+		}
+
+		for _, match := range matches {
+			addr, err := serverAddressFromLeaseFile(match)
+			if err != nil {
+				klog.V(4).Infof("Could not parse lease file %v: %v", match, err)
+				continue
+			}
+			if addr != "" {
+				return addr, nil
+			}
+		}
+	}
+
+	return "", errors.New("no dhcp-server-identifier found in any known lease file")
+}
+
+// serverAddressFromLeaseFile returns the last DHCP server address recorded
+// in the given lease file, since dhclient appends new leases to the end of
+// the file and the most recent one is authoritative.
+func serverAddressFromLeaseFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var lastMatch string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := dhclientServerIdentifierRegex.FindStringSubmatch(line); m != nil {
+			lastMatch = m[1]
+			continue
+		}
+
+		if m := systemdServerAddressRegex.FindStringSubmatch(line); m != nil {
+			lastMatch = m[1]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return lastMatch, nil
+}
+
+// get fetches a single meta-data key from the metadata server, e.g.
+// "instance-id" or "local-ipv4".
+func (m *metadataClient) get(key string) (string, error) {
+	url := fmt.Sprintf(metadataBaseURLFormat, m.serverAddr) + key
+
+	resp, err := m.httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("error contacting metadata server for %v: %v", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %v for %v", resp.Status, key)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading metadata response for %v: %v", key, err)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (m *metadataClient) instanceID() (string, error)      { return m.get("instance-id") }
+func (m *metadataClient) localIPv4() (string, error)       { return m.get("local-ipv4") }
+func (m *metadataClient) publicIPv4() (string, error)      { return m.get("public-ipv4") }
+func (m *metadataClient) serviceOffering() (string, error) { return m.get("service-offering") }
+func (m *metadataClient) availabilityZone() (string, error) {
+	return m.get("availability-zone")
+}
+func (m *metadataClient) publicHostname() (string, error) { return m.get("public-hostname") }
@@ -0,0 +1,207 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultAPIQPS and defaultAPIBurst are used when CSConfig.Global.APIQPS
+	// / APIBurst are unset.
+	defaultAPIQPS   = 10
+	defaultAPIBurst = 20
+
+	retryInitialBackoff = 200 * time.Millisecond
+	retryBackoffFactor  = 2
+	retryMaxAttempts    = 5
+
+	// cloudStackResourceBusyErrorCode is the CloudStack errorcode returned
+	// (with an HTTP 200) when a resource is locked by another job.
+	cloudStackResourceBusyErrorCode = 431
+)
+
+var (
+	apiRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudstack_api_requests_total",
+			Help: "Total number of CloudStack API requests, by operation (command) and response code.",
+		},
+		[]string{"op", "code"},
+	)
+
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cloudstack_api_request_duration_seconds",
+			Help:    "Latency of CloudStack API requests, by operation (command).",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"op"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiRequestsTotal, apiRequestDuration)
+}
+
+// retryingTransport wraps a base http.RoundTripper with capped exponential
+// backoff retries, client-side rate limiting and Prometheus instrumentation.
+// Installing it once as CSCloud's HTTP client transport means every
+// CloudStack API call (VirtualMachine, VPC, Network, Resourcetags, ...)
+// transparently gets the same resilience policy, without each call site
+// having to implement it.
+type retryingTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+// newRetryingTransport wraps base (defaulting to http.DefaultTransport) with
+// a limiter allowing qps requests per second, bursting up to burst.
+func newRetryingTransport(base http.RoundTripper, qps float64, burst int) *retryingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if qps <= 0 {
+		qps = defaultAPIQPS
+	}
+	if burst <= 0 {
+		burst = defaultAPIBurst
+	}
+
+	return &retryingTransport{
+		base:    base,
+		limiter: rate.NewLimiter(rate.Limit(qps), burst),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := apiOperation(req)
+	backoff := retryInitialBackoff
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 1; attempt <= retryMaxAttempts; attempt++ {
+		if werr := t.limiter.Wait(req.Context()); werr != nil {
+			return nil, werr
+		}
+
+		start := time.Now()
+		resp, err = t.base.RoundTrip(req)
+		apiRequestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+
+		var body []byte
+		if resp != nil && resp.Body != nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		apiRequestsTotal.WithLabelValues(op, responseCode(resp, err)).Inc()
+
+		if attempt == retryMaxAttempts || !shouldRetry(resp, err, body) {
+			break
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		klog.V(4).Infof("Retrying CloudStack API call %v (attempt %v/%v) in %v", op, attempt, retryMaxAttempts, sleep)
+		time.Sleep(sleep)
+		backoff *= retryBackoffFactor
+
+		if req.GetBody != nil {
+			body, berr := req.GetBody()
+			if berr != nil {
+				break
+			}
+			req.Body = body
+		}
+	}
+
+	return resp, err
+}
+
+// shouldRetry reports whether a CloudStack API call should be retried: on
+// network errors, HTTP 5xx responses, or a CloudStack "resource busy"
+// (errorcode 431) response, which CloudStack returns with an HTTP 200.
+func shouldRetry(resp *http.Response, err error, body []byte) bool {
+	if err != nil {
+		return true
+	}
+	if resp == nil {
+		return true
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+
+	return cloudStackErrorCode(body) == cloudStackResourceBusyErrorCode
+}
+
+// cloudStackErrorCode extracts the "errorcode" field CloudStack nests inside
+// its single top-level response wrapper object, e.g.
+// {"listvirtualmachinesresponse":{"errorcode":431,...}}.
+func cloudStackErrorCode(body []byte) int {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return 0
+	}
+
+	for _, raw := range envelope {
+		var payload struct {
+			ErrorCode int `json:"errorcode"`
+		}
+		if err := json.Unmarshal(raw, &payload); err == nil && payload.ErrorCode != 0 {
+			return payload.ErrorCode
+		}
+	}
+
+	return 0
+}
+
+// apiOperation extracts the CloudStack "command" query parameter to use as
+// the Prometheus "op" label, e.g. "listVirtualMachines".
+func apiOperation(req *http.Request) string {
+	if req.URL == nil {
+		return "unknown"
+	}
+	if cmd := req.URL.Query().Get("command"); cmd != "" {
+		return cmd
+	}
+	return req.URL.Path
+}
+
+// responseCode turns a RoundTrip result into a Prometheus label value.
+func responseCode(resp *http.Response, err error) string {
+	if resp == nil || err != nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCloudStackErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{
+			name: "resource busy",
+			body: `{"listvirtualmachinesresponse":{"errorcode":431,"errortext":"resource is busy"}}`,
+			want: 431,
+		},
+		{
+			name: "no error",
+			body: `{"listvirtualmachinesresponse":{"count":0,"virtualmachine":[]}}`,
+			want: 0,
+		},
+		{
+			name: "malformed json",
+			body: `not json`,
+			want: 0,
+		},
+		{
+			name: "empty body",
+			body: ``,
+			want: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cloudStackErrorCode([]byte(test.body)); got != test.want {
+				t.Errorf("cloudStackErrorCode(%q) = %v, want %v", test.body, got, test.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		body string
+		want bool
+	}{
+		{
+			name: "transport error",
+			err:  errors.New("connection reset"),
+			want: true,
+		},
+		{
+			name: "nil response",
+			want: true,
+		},
+		{
+			name: "server error",
+			resp: &http.Response{StatusCode: http.StatusServiceUnavailable},
+			want: true,
+		},
+		{
+			name: "resource busy errorcode",
+			resp: &http.Response{StatusCode: http.StatusOK},
+			body: `{"createstaticrouteresponse":{"errorcode":431}}`,
+			want: true,
+		},
+		{
+			name: "ok response",
+			resp: &http.Response{StatusCode: http.StatusOK},
+			body: `{"createstaticrouteresponse":{"id":"abc"}}`,
+			want: false,
+		},
+		{
+			name: "not found is not retried",
+			resp: &http.Response{StatusCode: http.StatusNotFound},
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shouldRetry(test.resp, test.err, []byte(test.body)); got != test.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAPIOperation(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "command query param",
+			url:  "https://example.com/client/api?command=listVirtualMachines&response=json",
+			want: "listVirtualMachines",
+		},
+		{
+			name: "no command falls back to path",
+			url:  "https://example.com/client/api",
+			want: "/client/api",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatalf("url.Parse(%q) error = %v", test.url, err)
+			}
+
+			req := &http.Request{URL: u}
+			if got := apiOperation(req); got != test.want {
+				t.Errorf("apiOperation(%q) = %v, want %v", test.url, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want string
+	}{
+		{name: "success", resp: &http.Response{StatusCode: http.StatusOK}, want: "200"},
+		{name: "transport error", err: errors.New("boom"), want: "error"},
+		{name: "nil response", want: "error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := responseCode(test.resp, test.err); got != test.want {
+				t.Errorf("responseCode() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}